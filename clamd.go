@@ -26,13 +26,14 @@ SOFTWARE.
 package clamd
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"net"
 	"net/url"
 	"os"
-	"strings"
 	"time"
 )
 
@@ -45,14 +46,20 @@ const (
 
 type Clamd struct {
 	address string
-}
 
-type Stats struct {
-	Pools    string
-	State    string
-	Threads  string
-	Memstats string
-	Queue    string
+	// pool, when set, backs ScanFile and ScanStream with a SessionPool of
+	// persistent IDSESSION connections instead of dialing a fresh
+	// connection per call. See NewPooledClamd.
+	pool *SessionPool
+
+	// logger and onScanEvent are always accessed through log()/emit() so a
+	// Clamd built as a struct literal still gets the no-op defaults.
+	logger      Logger
+	onScanEvent OnScanEvent
+
+	// tlsConfig is used to dial "tls://" and "clamd+tls://" addresses. See
+	// SetTLSConfig.
+	tlsConfig *tls.Config
 }
 
 type ScanResult struct {
@@ -66,7 +73,7 @@ type ScanResult struct {
 
 var EICAR = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
 
-func (c *Clamd) newConnection() (conn *CLAMDConn, err error) {
+func (c *Clamd) newConnection(ctx context.Context) (conn *CLAMDConn, err error) {
 	var u *url.URL
 
 	if u, err = url.Parse(c.address); err != nil {
@@ -75,63 +82,73 @@ func (c *Clamd) newConnection() (conn *CLAMDConn, err error) {
 
 	switch u.Scheme {
 	case "tcp":
-		conn, err = newCLAMDTcpConn(u.Host)
+		var nc net.Conn
+		d := net.Dialer{Timeout: TCP_TIMEOUT}
+		if nc, err = d.DialContext(ctx, "tcp", u.Host); err != nil {
+			return
+		}
+		conn, err = newCLAMDTcpConn(nc)
+	case "tls", "clamd+tls":
+		var nc net.Conn
+		td := tls.Dialer{NetDialer: &net.Dialer{Timeout: TCP_TIMEOUT}, Config: c.tlsConfig}
+		if nc, err = td.DialContext(ctx, "tcp", u.Host); err != nil {
+			return
+		}
+		conn, err = newCLAMDTcpConn(nc)
 	case "unix":
-		conn, err = newCLAMDUnixConn(u.Path)
+		conn, err = newCLAMDUnixConn(ctx, u.Path)
 	default:
-		conn, err = newCLAMDUnixConn(c.address)
+		conn, err = newCLAMDUnixConn(ctx, c.address)
 	}
 
 	return
 }
 
-func (c *Clamd) simpleCommand(command string) (chan *ScanResult, error) {
-	conn, err := c.newConnection()
+func (c *Clamd) simpleCommand(ctx context.Context, command string) (chan *ScanResult, error) {
+	conn, err := c.newConnection(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	preSendCommand := time.Now()
-	err = conn.sendCommand(command)
+	err = conn.sendCommand(ctx, command)
 	postSendCommand := time.Now()
 	if err != nil {
 		return nil, err
 	}
+	c.emit(command, "send", postSendCommand.Sub(preSendCommand))
 
 	preReadResponse := time.Now()
-	ch, wg, err := conn.readResponse()
+	ch, wg, err := conn.readResponse(ctx)
 	postReadResponse := time.Now()
+	c.emit(command, "read", postReadResponse.Sub(preReadResponse))
 
 	go func() {
 		wg.Wait()
-		err := conn.Close()
-		if err != nil {
-			//goland:noinspection GoUnhandledErrorResult
-			fmt.Fprintf(os.Stderr, "failed to close connection in ScanStream: %s", err)
+		if err := conn.Close(); err != nil {
+			c.log().Warnf("clamd: failed to close connection after %s: %s", command, err)
 		}
 
-		postConnectionClose := time.Now()
-		if command != "VERSION" {
-			fmt.Printf("\tpreSend -> postConnectionClose: %s\n", postConnectionClose.Sub(preSendCommand))
-		}
+		c.emit(command, "total", time.Now().Sub(preSendCommand))
 	}()
 
-	if command != "VERSION" {
-		s := fmt.Sprintf("=====[%s]:\n\tpreSend -> postRead: %f\n", command, postReadResponse.Sub(preSendCommand).Seconds())
-		s += fmt.Sprintf("\tpostSend -> preSend: %f\n", postSendCommand.Sub(preSendCommand).Seconds())
-		s += fmt.Sprintf("\tpostRead -> preRead: %f", postReadResponse.Sub(preReadResponse).Seconds())
-
-		fmt.Println(s)
-	}
+	c.log().Debugf("clamd: %s preSend->postRead=%s postSend->preSend=%s postRead->preRead=%s",
+		command,
+		postReadResponse.Sub(preSendCommand),
+		postSendCommand.Sub(preSendCommand),
+		postReadResponse.Sub(preReadResponse),
+	)
 
 	return ch, err
 }
 
 /*
-Ping checks the daemon's state (should reply with PONG).
+Ping checks the daemon's state (should reply with PONG). ctx governs the
+dial, write and read deadlines for the round trip and can be used to cancel
+it early.
 */
-func (c *Clamd) Ping() error {
-	ch, err := c.simpleCommand("PING")
+func (c *Clamd) Ping(ctx context.Context) error {
+	ch, err := c.simpleCommand(ctx, "PING")
 	if err != nil {
 		return err
 	}
@@ -148,49 +165,38 @@ func (c *Clamd) Ping() error {
 }
 
 /*
-Version prints program and database versions
+Version prints program and database versions. ctx governs the dial, write
+and read deadlines for the round trip and can be used to cancel it early.
 */
-func (c *Clamd) Version() (*ScanResult, error) {
-	dataArrays, err := c.simpleCommand("VERSION")
+func (c *Clamd) Version(ctx context.Context) (*ScanResult, error) {
+	dataArrays, err := c.simpleCommand(ctx, "VERSION")
 	return <-dataArrays, err
 }
 
 // Stats provides clamd statistics about the scan queue, contents of scan
-// queue, and memory usage. The exact reply format is subject to changes in future
-// releases.
-func (c *Clamd) Stats() (*Stats, error) {
-	ch, err := c.simpleCommand("STATS")
+// queue, and memory usage, parsed into typed fields (see Stats.Raw for the
+// unparsed reply). ctx governs the dial, write and read deadlines for the
+// round trip and can be used to cancel it early.
+func (c *Clamd) Stats(ctx context.Context) (*Stats, error) {
+	ch, err := c.simpleCommand(ctx, "STATS")
 	if err != nil {
 		return nil, err
 	}
 
-	stats := &Stats{}
-
+	var lines []string
 	for s := range ch {
-		if strings.HasPrefix(s.Raw, "POOLS") {
-			stats.Pools = strings.Trim(s.Raw[6:], " ")
-		} else if strings.HasPrefix(s.Raw, "STATE") {
-			stats.State = s.Raw
-		} else if strings.HasPrefix(s.Raw, "THREADS") {
-			stats.Threads = s.Raw
-		} else if strings.HasPrefix(s.Raw, "QUEUE") {
-			stats.Queue = s.Raw
-		} else if strings.HasPrefix(s.Raw, "MEMSTATS") {
-			stats.Memstats = s.Raw
-		} else if strings.HasPrefix(s.Raw, "END") {
-		} else {
-			return nil, errors.New(fmt.Sprintf("Unknown response, got %v.", s))
-		}
+		lines = append(lines, s.Raw)
 	}
 
-	return stats, nil
+	return parseStats(lines)
 }
 
 /*
-Reload the databases.
+Reload the databases. ctx governs the dial, write and read deadlines for the
+round trip and can be used to cancel it early.
 */
-func (c *Clamd) Reload() error {
-	ch, err := c.simpleCommand("RELOAD")
+func (c *Clamd) Reload(ctx context.Context) error {
+	ch, err := c.simpleCommand(ctx, "RELOAD")
 	if err != nil {
 		return err
 	}
@@ -206,8 +212,8 @@ func (c *Clamd) Reload() error {
 	}
 }
 
-func (c *Clamd) Shutdown() error {
-	_, err := c.simpleCommand("SHUTDOWN")
+func (c *Clamd) Shutdown(ctx context.Context) error {
+	_, err := c.simpleCommand(ctx, "SHUTDOWN")
 	if err != nil {
 		return err
 	}
@@ -217,51 +223,82 @@ func (c *Clamd) Shutdown() error {
 
 /*
 ScanFile scans a file or directory (recursively) with archive support enabled (a full path is
-required).
+required). ctx governs the dial, write and read deadlines for the scan and
+can be used to cancel it early.
 */
-func (c *Clamd) ScanFile(path string) (*ScanResult, error) {
+func (c *Clamd) ScanFile(ctx context.Context, path string) (*ScanResult, error) {
+	if c.pool != nil {
+		return c.pool.ScanFile(ctx, path)
+	}
+
+	// The FILDES fast path hands clamd a single open file descriptor, so it
+	// only applies to a regular file; a directory (or any path os.Stat
+	// does not report as a regular file) still needs the SCAN command so
+	// clamd can recurse into it itself. On the Windows build scanFileByFD
+	// has no FILDES path and sends SCAN itself.
+	if c.isUnixSocket() {
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			return c.scanFileByFD(ctx, path)
+		}
+	}
+
 	command := fmt.Sprintf("SCAN %s", path)
-	ch, err := c.simpleCommand(command)
+	ch, err := c.simpleCommand(ctx, command)
 	return <-ch, err
 }
 
+// isUnixSocket reports whether c.address names a unix socket, i.e. it has
+// no scheme (a raw path) or an explicit "unix" scheme.
+func (c *Clamd) isUnixSocket() bool {
+	u, err := url.Parse(c.address)
+	if err != nil {
+		return true
+	}
+
+	return u.Scheme == "" || u.Scheme == "unix"
+}
+
 /*
 RawScanFile scans a file or directory (recursively) with archive and special file support disabled
-(a full path is required).
+(a full path is required). ctx governs the dial, write and read deadlines
+for the scan and can be used to cancel it early.
 */
-func (c *Clamd) RawScanFile(path string) (*ScanResult, error) {
+func (c *Clamd) RawScanFile(ctx context.Context, path string) (*ScanResult, error) {
 	command := fmt.Sprintf("RAWSCAN %s", path)
-	ch, err := c.simpleCommand(command)
+	ch, err := c.simpleCommand(ctx, command)
 	return <-ch, err
 }
 
 /*
 MultiScanFile scans multiple files in a standard way or scan directory (recursively) using multiple threads
-(to make the scanning faster on SMP machines).
+(to make the scanning faster on SMP machines). ctx governs the dial, write
+and read deadlines for the scan and can be used to cancel it early.
 */
-func (c *Clamd) MultiScanFile(path string) (*ScanResult, error) {
+func (c *Clamd) MultiScanFile(ctx context.Context, path string) (*ScanResult, error) {
 	command := fmt.Sprintf("MULTISCAN %s", path)
-	ch, err := c.simpleCommand(command)
+	ch, err := c.simpleCommand(ctx, command)
 	return <-ch, err
 }
 
 /*
 ContScanFile scans a file or directory (recursively) with archive support enabled and don’t stop
-the scanning when a virus is found.
+the scanning when a virus is found. ctx governs the dial, write and read
+deadlines for the scan and can be used to cancel it early.
 */
-func (c *Clamd) ContScanFile(path string) (*ScanResult, error) {
+func (c *Clamd) ContScanFile(ctx context.Context, path string) (*ScanResult, error) {
 	command := fmt.Sprintf("CONTSCAN %s", path)
-	ch, err := c.simpleCommand(command)
+	ch, err := c.simpleCommand(ctx, command)
 	return <-ch, err
 }
 
 /*
 AllMatchScanFile scans a files or directory (recursively) with archive support enabled and don’t stop
-the scanning when a virus is found.
+the scanning when a virus is found. ctx governs the dial, write and read
+deadlines for the scan and can be used to cancel it early.
 */
-func (c *Clamd) AllMatchScanFile(path string) (*ScanResult, error) {
+func (c *Clamd) AllMatchScanFile(ctx context.Context, path string) (*ScanResult, error) {
 	command := fmt.Sprintf("ALLMATCHSCAN %s", path)
-	ch, err := c.simpleCommand(command)
+	ch, err := c.simpleCommand(ctx, command)
 	return <-ch, err
 }
 
@@ -273,51 +310,61 @@ chunk is: <length><data> where <length> is the size of the following data in
 bytes expressed as a 4 byte unsigned integer in network byte order and <data> is
 the actual chunk. Streaming is terminated by sending a zero-length chunk. Note:
 do not exceed StreamMaxLength as defined in clamd.conf, otherwise clamd will
-reply with INSTREAM size limit exceeded and close the connection
+reply with INSTREAM size limit exceeded and close the connection.
+
+ctx governs the dial, write and read deadlines for the whole stream and, if
+cancelled while chunks are still being sent, aborts the chunk loop and
+closes the underlying connection. For a Clamd from NewPooledClamd the
+stream goes over a shared session connection instead: a cancelled ctx does
+not close it or stop the chunks already being sent, it ends the wait for
+the response; ctx's deadline, if any, still bounds each write.
 */
-func (c *Clamd) ScanStream(r io.Reader, abort chan bool) (chan *ScanResult, error) {
-	id := rand.Intn(1000000)
-	s := time.Now()
-	sO := time.Now()
-	conn, err := c.newConnection()
+func (c *Clamd) ScanStream(ctx context.Context, r io.Reader) (chan *ScanResult, error) {
+	if c.pool != nil {
+		res, err := c.pool.ScanStream(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+
+		ch := make(chan *ScanResult, 1)
+		ch <- res
+		close(ch)
+		return ch, nil
+	}
+
+	start := time.Now()
+	phase := time.Now()
+
+	conn, err := c.newConnection(ctx)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("[ScanStream(%d)] newConnection: %s\n", id, time.Now().Sub(s))
-	s = time.Now()
-
-	go func() {
-		for {
-			_, allowRunning := <-abort
-			if !allowRunning {
-				break
-			}
-		}
-		err := conn.Close()
-		if err != nil {
-			//goland:noinspection GoUnhandledErrorResult
-			fmt.Fprintf(os.Stderr, "failed to close connection in ScanStream: %s", err)
-		}
-	}()
+	c.emit("INSTREAM", "connect", time.Now().Sub(phase))
+	phase = time.Now()
 
-	fmt.Printf("[ScanStream(%d)] preSendCommand(INSTREAM): %s\n", id, time.Now().Sub(s))
-	s = time.Now()
-	err = conn.sendCommand("INSTREAM")
+	err = conn.sendCommand(ctx, "INSTREAM")
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("[ScanStream(%d)] postSendCommand(INSTREAM): %s\n", id, time.Now().Sub(s))
-	s = time.Now()
+	c.emit("INSTREAM", "sendCommand", time.Now().Sub(phase))
+	phase = time.Now()
 
+chunkLoop:
 	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break chunkLoop
+		default:
+		}
+
 		buf := make([]byte, CHUNK_SIZE)
 
 		nr, err := r.Read(buf)
 		if nr > 0 {
-			err = conn.sendChunk(buf[0:nr])
+			err = conn.sendChunk(ctx, buf[0:nr])
 			if err != nil {
-				//goland:noinspection GoUnhandledErrorResult
-				fmt.Fprintf(os.Stderr, "failed to write chunk to connection in ScanStream: %s", err)
+				c.log().Warnf("clamd: failed to write chunk to connection in ScanStream: %s", err)
 			}
 		}
 
@@ -325,34 +372,36 @@ func (c *Clamd) ScanStream(r io.Reader, abort chan bool) (chan *ScanResult, erro
 			break
 		}
 	}
-	fmt.Printf("[ScanStream(%d)] postFileSend(INSTREAM): %s\n", id, time.Now().Sub(s))
-	s = time.Now()
+	c.emit("INSTREAM", "sendChunks", time.Now().Sub(phase))
+	phase = time.Now()
+
+	if ctx.Err() != nil {
+		//goland:noinspection GoUnhandledErrorResult
+		conn.Close()
+		return nil, ctx.Err()
+	}
 
-	err = conn.sendEOF()
+	err = conn.sendEOF(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("[ScanStream(%d)] preReadResponse(INSTREAM): %s\n", id, time.Now().Sub(s))
-	s = time.Now()
-	ch, wg, err := conn.readResponse()
-	fmt.Printf("[ScanStream(%d)] postReadResponse(INSTREAM): %s\n", id, time.Now().Sub(s))
-	s = time.Now()
+	ch, wg, err := conn.readResponse(ctx)
+	c.emit("INSTREAM", "readResponse", time.Now().Sub(phase))
 
 	go func() {
-		s = time.Now()
+		waitStart := time.Now()
 		wg.Wait()
-		fmt.Printf("[ScanStream(%d)] postWaitGroupWait(INSTREAM): %s\n", id, time.Now().Sub(s))
-		s = time.Now()
-		err := conn.Close()
-		if err != nil {
-			//goland:noinspection GoUnhandledErrorResult
-			fmt.Fprintf(os.Stderr, "failed to close connection in ScanStream: %s", err)
+		c.emit("INSTREAM", "wait", time.Now().Sub(waitStart))
+
+		closeStart := time.Now()
+		if err := conn.Close(); err != nil {
+			c.log().Warnf("clamd: failed to close connection in ScanStream: %s", err)
 		}
-		fmt.Printf("[ScanStream(%d)] postConnClose(INSTREAM): %s\n", id, time.Now().Sub(s))
+		c.emit("INSTREAM", "close", time.Now().Sub(closeStart))
 	}()
 
-	fmt.Printf("[ScanStream(%d)] complete: %s\n", id, time.Now().Sub(sO))
+	c.emit("INSTREAM", "total", time.Now().Sub(start))
 	return ch, nil
 }
 
@@ -360,3 +409,20 @@ func NewClamd(address string) *Clamd {
 	clamd := &Clamd{address: address}
 	return clamd
 }
+
+// NewPooledClamd returns a Clamd whose ScanFile and ScanStream calls are
+// served by a bounded SessionPool of poolSize persistent IDSESSION
+// connections instead of dialing a fresh connection per scan. This is
+// intended for high-volume callers, such as an SMTP or HTTP gateway, that
+// would otherwise pay a new TCP/unix connect for every scan. tlsConfig is
+// used to dial "tls://"/"clamd+tls://" addresses, both for the pool's
+// connections and for any command the returned Clamd issues outside of it;
+// it is ignored for other schemes and may be nil.
+func NewPooledClamd(ctx context.Context, address string, poolSize int, tlsConfig *tls.Config) (*Clamd, error) {
+	pool, err := NewSessionPool(ctx, address, poolSize, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Clamd{address: address, pool: pool, tlsConfig: tlsConfig}, nil
+}
@@ -0,0 +1,270 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CHUNK_SIZE  = 1024
+	TCP_TIMEOUT = 2 * time.Second
+)
+
+// CLAMDConn wraps the network connection to clamd. Every send and read
+// operation takes a context.Context, which supplies the read/write deadline
+// (from its Deadline, if any) and, when cancelled, aborts an in-flight
+// operation by closing the underlying connection. The sendSession* methods
+// are the exception: they use only the deadline and never close the
+// connection on cancellation (see sendSessionCommand).
+type CLAMDConn struct {
+	conn net.Conn
+}
+
+func newCLAMDUnixConn(ctx context.Context, path string) (*CLAMDConn, error) {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CLAMDConn{conn}, nil
+}
+
+// newCLAMDTcpConn wraps an already-dialed net.Conn. The caller is
+// responsible for dialing it, plain or over TLS, so the same read/write
+// plumbing in CLAMDConn serves both transports.
+func newCLAMDTcpConn(conn net.Conn) (*CLAMDConn, error) {
+	return &CLAMDConn{conn}, nil
+}
+
+// watchContext closes the connection as soon as ctx is done, aborting
+// whatever read or write is currently blocked on it. The caller must invoke
+// the returned stop func once its operation has finished, successfully or
+// not, to release the watcher goroutine.
+func (c *CLAMDConn) watchContext(ctx context.Context) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			//goland:noinspection GoUnhandledErrorResult
+			c.conn.Close()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func (c *CLAMDConn) sendCommand(ctx context.Context, command string) (err error) {
+	stop := c.watchContext(ctx)
+	defer stop()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = c.conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	cmd := fmt.Sprintf("z%s\000", command)
+	_, err = c.conn.Write([]byte(cmd))
+	return
+}
+
+// setSessionWriteDeadline applies ctx's deadline, if any, to c.conn, and
+// clears any deadline left behind by an earlier request otherwise. This
+// matters because c.conn here is a sessionConn's shared, persistent
+// socket: without clearing it, a deadline set for one request would still
+// be in effect - and likely already past - for the next one.
+func (c *CLAMDConn) setSessionWriteDeadline(ctx context.Context) error {
+	deadline, _ := ctx.Deadline()
+	return c.conn.SetWriteDeadline(deadline)
+}
+
+// sendSessionCommand frames command the same way sendCommand does: a "z"
+// prefix and a NUL terminator. Because the connection is in IDSESSION mode,
+// clamd tags the response with the request's id and keeps the connection
+// open once it has answered.
+//
+// Unlike sendCommand, it does not watchContext: c.conn here is a
+// sessionConn's single persistent socket, multiplexed across every request
+// pipelined on it, so cancelling one caller's ctx must not close it out
+// from under every other pending request. ctx.Deadline(), if set, still
+// bounds the write via SetWriteDeadline.
+func (c *CLAMDConn) sendSessionCommand(ctx context.Context, command string) (err error) {
+	if err = c.setSessionWriteDeadline(ctx); err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("z%s\000", command)
+	_, err = c.conn.Write([]byte(cmd))
+	return
+}
+
+// sendSessionChunk frames data as an INSTREAM chunk the same way sendChunk
+// does, without watchContext; see sendSessionCommand for why.
+func (c *CLAMDConn) sendSessionChunk(ctx context.Context, data []byte) (err error) {
+	if err = c.setSessionWriteDeadline(ctx); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+
+	if _, err = c.conn.Write(buf); err != nil {
+		return err
+	}
+
+	_, err = c.conn.Write(data)
+	return
+}
+
+// sendSessionEOF writes the INSTREAM terminator the same way sendEOF does,
+// without watchContext; see sendSessionCommand for why.
+func (c *CLAMDConn) sendSessionEOF(ctx context.Context) (err error) {
+	if err = c.setSessionWriteDeadline(ctx); err != nil {
+		return err
+	}
+
+	_, err = c.conn.Write([]byte{0, 0, 0, 0})
+	return
+}
+
+func (c *CLAMDConn) sendChunk(ctx context.Context, data []byte) (err error) {
+	stop := c.watchContext(ctx)
+	defer stop()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = c.conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+
+	if _, err = c.conn.Write(buf); err != nil {
+		return err
+	}
+
+	_, err = c.conn.Write(data)
+	return
+}
+
+func (c *CLAMDConn) sendEOF(ctx context.Context) (err error) {
+	stop := c.watchContext(ctx)
+	defer stop()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = c.conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	_, err = c.conn.Write([]byte{0, 0, 0, 0})
+	return
+}
+
+func (c *CLAMDConn) Close() error {
+	return c.conn.Close()
+}
+
+// readResponse reads clamd's NUL-terminated response lines until EOF,
+// parsing each into a ScanResult and delivering it on the returned channel.
+// The caller must wait on wg before assuming the channel has been drained.
+// ctx supplies the read deadline and, if cancelled while a read is blocked,
+// aborts the loop by closing the connection.
+func (c *CLAMDConn) readResponse(ctx context.Context) (ch chan *ScanResult, wg *sync.WaitGroup, err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = c.conn.SetReadDeadline(deadline); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ch = make(chan *ScanResult)
+	wg = &sync.WaitGroup{}
+	wg.Add(1)
+
+	reader := bufio.NewReader(c.conn)
+
+	go func() {
+		defer wg.Done()
+		defer close(ch)
+
+		stop := c.watchContext(ctx)
+		defer stop()
+
+		for {
+			line, err := reader.ReadString(0)
+			if err != nil {
+				return
+			}
+
+			line = strings.TrimRight(line, "\x00")
+			line = strings.TrimRight(line, "\n")
+
+			ch <- parseResponse(line)
+		}
+	}()
+
+	return
+}
+
+func parseResponse(line string) *ScanResult {
+	result := &ScanResult{Raw: line}
+
+	idx := strings.LastIndex(line, ": ")
+	if idx < 0 {
+		return result
+	}
+
+	result.Path = line[:idx]
+	status := line[idx+2:]
+
+	switch {
+	case status == RES_OK:
+		result.Status = RES_OK
+	case strings.HasSuffix(status, RES_FOUND):
+		result.Status = RES_FOUND
+		result.Description = strings.TrimSpace(strings.TrimSuffix(status, RES_FOUND))
+	case strings.HasPrefix(status, "ERROR"):
+		result.Status = RES_ERROR
+		result.Description = status
+	default:
+		result.Status = RES_PARSE_ERROR
+	}
+
+	return result
+}
@@ -0,0 +1,83 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import "testing"
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		status string
+		path   string
+		desc   string
+	}{
+		{
+			name:   "clean",
+			line:   "/tmp/file: OK",
+			status: RES_OK,
+			path:   "/tmp/file",
+		},
+		{
+			name:   "found",
+			line:   "/tmp/eicar.com: Eicar-Test-Signature FOUND",
+			status: RES_FOUND,
+			path:   "/tmp/eicar.com",
+			desc:   "Eicar-Test-Signature",
+		},
+		{
+			name:   "error",
+			line:   "/tmp/missing: ERROR No such file or directory",
+			status: RES_ERROR,
+			path:   "/tmp/missing",
+			desc:   "ERROR No such file or directory",
+		},
+		{
+			name:   "unparseable",
+			line:   "not a clamd response",
+			status: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := parseResponse(tt.line)
+
+			if result.Raw != tt.line {
+				t.Errorf("Raw = %q, want %q", result.Raw, tt.line)
+			}
+			if result.Status != tt.status {
+				t.Errorf("Status = %q, want %q", result.Status, tt.status)
+			}
+			if result.Path != tt.path {
+				t.Errorf("Path = %q, want %q", result.Path, tt.path)
+			}
+			if result.Description != tt.desc {
+				t.Errorf("Description = %q, want %q", result.Description, tt.desc)
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package clamdhttp provides an http.Handler middleware that scans request
+// bodies and multipart file uploads through clamd before they reach the
+// wrapped handler, so callers embedding go-clamd in a server or reverse
+// proxy don't have to reimplement that plumbing themselves.
+package clamdhttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	clamd "github.com/torbencarstensbit/go-clamd"
+)
+
+// Scanner is the subset of *clamd.Clamd the middleware depends on, so
+// callers can substitute a fake in their own tests.
+type Scanner interface {
+	ScanStream(ctx context.Context, r io.Reader) (chan *clamd.ScanResult, error)
+}
+
+// OversizeAction controls what happens when a body or part is larger than
+// Config.MaxBodySize.
+type OversizeAction int
+
+const (
+	// OversizeReject answers the request with Config.RejectStatus without
+	// scanning or forwarding it. This is the default.
+	OversizeReject OversizeAction = iota
+
+	// OversizeForward forwards the oversized body or part to next
+	// unscanned. Useful when Config.MaxBodySize tracks clamd's own
+	// StreamMaxLength and oversized uploads are expected to be rejected by
+	// clamd itself or handled downstream instead.
+	OversizeForward
+)
+
+// Finding describes why Middleware rejected a request.
+type Finding struct {
+	Signature string `json:"signature"`
+	Part      string `json:"part,omitempty"`
+	Hash      string `json:"hash"`
+}
+
+// ScanMode selects when a body is read relative to being scanned.
+type ScanMode int
+
+const (
+	// ScanBuffered fully buffers a body, scans the buffer, and only then
+	// forwards it to next. This is the default; it never starts a scan on
+	// bytes that haven't been read in full yet.
+	ScanBuffered ScanMode = iota
+
+	// ScanParallel reads a body once, tee'd through an io.Pipe, so the
+	// read and the scan run concurrently instead of back to back. next is
+	// still only invoked once the scan verdict is known, so this saves
+	// wall-clock time on the read rather than forwarding unscanned bytes.
+	ScanParallel
+)
+
+// Config controls how Middleware scans requests.
+type Config struct {
+	// Scanner performs the scan. Required.
+	Scanner Scanner
+
+	// MaxBodySize bounds how many bytes of a request body, or of each
+	// multipart.Part, are buffered and scanned. Zero means unbounded.
+	MaxBodySize int64
+
+	// OnOversize selects what happens once MaxBodySize is exceeded.
+	// Defaults to OversizeReject.
+	OnOversize OversizeAction
+
+	// Mode selects whether a body is scanned only once it has been fully
+	// buffered (ScanBuffered, the default) or tee'd through an io.Pipe so
+	// the read and the scan overlap (ScanParallel).
+	Mode ScanMode
+
+	// ContentTypes restricts scanning to requests whose Content-Type
+	// matches one of these (exact match against the media type, ignoring
+	// parameters). A nil slice scans every content type.
+	ContentTypes []string
+
+	// RejectStatus is the HTTP status written when clamd reports FOUND.
+	// Defaults to http.StatusBadRequest.
+	RejectStatus int
+
+	// OnEvent, if set, is called once per scan with its outcome, for
+	// logging or metrics. err is non-nil only for scanner failures, not
+	// for a clean/FOUND verdict.
+	OnEvent func(r *http.Request, result *clamd.ScanResult, err error)
+}
+
+// Middleware wraps next with clamd scanning. Plain request bodies are
+// scanned whole; multipart/form-data requests are scanned part by part, and
+// only parts with a filename (i.e. file uploads) are scanned, form fields
+// pass through untouched. On a FOUND verdict the request is short-circuited
+// with cfg.RejectStatus and a JSON body describing the signature, the
+// affected part name (for multipart requests), and a sha256 hash of the
+// offending content; next is never called for a request found infected.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	if cfg.Scanner == nil {
+		panic("clamdhttp: Config.Scanner is required")
+	}
+
+	if cfg.RejectStatus == 0 {
+		cfg.RejectStatus = http.StatusBadRequest
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.scans(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+		var (
+			body    io.ReadCloser
+			size    int64
+			finding *Finding
+			scanErr error
+		)
+
+		if mediaType == "multipart/form-data" {
+			body, size, finding, scanErr = cfg.scanMultipart(r, params["boundary"])
+		} else {
+			body, size, finding, scanErr = cfg.scanBody(r)
+		}
+
+		if scanErr != nil {
+			http.Error(w, "clamdhttp: scan failed", http.StatusInternalServerError)
+			return
+		}
+
+		if finding != nil {
+			writeRejection(w, cfg.RejectStatus, finding)
+			return
+		}
+
+		r.Body = body
+		r.ContentLength = size
+		if size >= 0 {
+			r.Header.Set("Content-Length", fmt.Sprintf("%d", size))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scans reports whether r's Content-Type is one Middleware should scan.
+func (cfg Config) scans(r *http.Request) bool {
+	if len(cfg.ContentTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	for _, ct := range cfg.ContentTypes {
+		if strings.EqualFold(ct, mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scanBody reads and scans the whole request body, per cfg.Mode.
+func (cfg Config) scanBody(r *http.Request) (io.ReadCloser, int64, *Finding, error) {
+	buf, oversize, finding, err := cfg.readAndScan(r, "", r.Body)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if oversize {
+		if cfg.OnOversize == OversizeForward {
+			// buf only holds the first MaxBodySize+1 bytes; the rest of
+			// the body is still sitting unread on r.Body. Chain them so
+			// next sees the whole thing instead of a truncated prefix.
+			return io.NopCloser(io.MultiReader(buf, r.Body)), r.ContentLength, nil, nil
+		}
+
+		return nil, 0, &Finding{Signature: "request body exceeds MaxBodySize"}, nil
+	}
+
+	if finding != nil {
+		return nil, 0, finding, nil
+	}
+
+	return io.NopCloser(bytes.NewReader(buf.Bytes())), int64(buf.Len()), nil, nil
+}
+
+// scanMultipart scans each file part of a multipart/form-data request,
+// passing non-file form fields through untouched, and re-encodes the
+// result into a fresh multipart body for next.
+func (cfg Config) scanMultipart(r *http.Request, boundary string) (io.ReadCloser, int64, *Finding, error) {
+	if boundary == "" {
+		return nil, 0, &Finding{Signature: "missing multipart boundary"}, nil
+	}
+
+	reader := multipart.NewReader(r.Body, boundary)
+
+	var out bytes.Buffer
+	writer := multipart.NewWriter(&out)
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		var (
+			buf      *bytes.Buffer
+			oversize bool
+			finding  *Finding
+		)
+
+		if part.FileName() != "" {
+			buf, oversize, finding, err = cfg.readAndScan(r, part.FormName(), part)
+		} else {
+			buf, oversize, err = cfg.readBounded(part)
+		}
+		if err != nil {
+			//goland:noinspection GoUnhandledErrorResult
+			part.Close()
+			return nil, 0, nil, err
+		}
+
+		if oversize && cfg.OnOversize == OversizeReject {
+			//goland:noinspection GoUnhandledErrorResult
+			part.Close()
+			return nil, 0, &Finding{Part: part.FormName(), Signature: "part exceeds MaxBodySize"}, nil
+		}
+
+		if finding != nil {
+			//goland:noinspection GoUnhandledErrorResult
+			part.Close()
+			return nil, 0, finding, nil
+		}
+
+		// buf only holds the first MaxBodySize+1 bytes of an oversize part
+		// forwarded unscanned; chain the rest of part on so it reaches next
+		// intact instead of truncated to the scan limit.
+		var content io.Reader = bytes.NewReader(buf.Bytes())
+		if oversize {
+			content = io.MultiReader(bytes.NewReader(buf.Bytes()), part)
+		}
+
+		err = copyPart(writer, part, content)
+		//goland:noinspection GoUnhandledErrorResult
+		part.Close()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, 0, nil, err
+	}
+
+	r.Header.Set("Content-Type", "multipart/form-data; boundary="+writer.Boundary())
+
+	return io.NopCloser(bytes.NewReader(out.Bytes())), int64(out.Len()), nil, nil
+}
+
+func copyPart(writer *multipart.Writer, part *multipart.Part, content io.Reader) error {
+	header := textproto.MIMEHeader{}
+	for k, v := range part.Header {
+		header[k] = v
+	}
+
+	dst, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, content)
+	return err
+}
+
+// readBounded buffers r up to cfg.MaxBodySize+1 bytes, reporting whether
+// the limit was exceeded.
+func (cfg Config) readBounded(r io.Reader) (*bytes.Buffer, bool, error) {
+	if cfg.MaxBodySize <= 0 {
+		buf := &bytes.Buffer{}
+		_, err := io.Copy(buf, r)
+		return buf, false, err
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(buf, r, cfg.MaxBodySize+1)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+
+	return buf, n > cfg.MaxBodySize, nil
+}
+
+// readAndScan reads src, bounded by cfg.MaxBodySize, into a buffer kept for
+// forwarding and scans it through cfg.Scanner, per cfg.Mode. part is the
+// multipart field name, empty for a plain body. If the read turns out to be
+// oversize, finding is always nil; the caller decides what that means.
+func (cfg Config) readAndScan(r *http.Request, part string, src io.Reader) (buf *bytes.Buffer, oversize bool, finding *Finding, err error) {
+	if cfg.Mode != ScanParallel {
+		buf, oversize, err = cfg.readBounded(src)
+		if err != nil || oversize {
+			return buf, oversize, nil, err
+		}
+
+		finding, err = cfg.scanBuffer(r, part, buf.Bytes())
+		return buf, false, finding, err
+	}
+
+	return cfg.readAndScanParallel(r, part, src)
+}
+
+// readAndScanParallel is the ScanParallel implementation of readAndScan: a
+// goroutine copies src into buf through an io.Pipe while cfg.Scanner drains
+// the other end, so the network read and the scan happen at the same time
+// instead of one after the other.
+func (cfg Config) readAndScanParallel(r *http.Request, part string, src io.Reader) (*bytes.Buffer, bool, *Finding, error) {
+	if cfg.MaxBodySize > 0 {
+		src = io.LimitReader(src, cfg.MaxBodySize+1)
+	}
+
+	pr, pw := io.Pipe()
+	buf := &bytes.Buffer{}
+
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.MultiWriter(buf, pw), src)
+		//goland:noinspection GoUnhandledErrorResult
+		pw.Close()
+		copyDone <- err
+	}()
+
+	result, scanErr := cfg.runScan(r, pr)
+
+	// If cfg.Scanner.ScanStream returned without having read pr to EOF -
+	// e.g. it failed to dial clamd before ever touching its argument -
+	// the copying goroutine's write to pw would otherwise block forever.
+	// Closing pr now unblocks it with io.ErrClosedPipe; if it already
+	// drained pr to EOF this is a harmless no-op.
+	//goland:noinspection GoUnhandledErrorResult
+	pr.Close()
+
+	if copyErr := <-copyDone; copyErr != nil {
+		return buf, false, nil, copyErr
+	}
+
+	if cfg.MaxBodySize > 0 && int64(buf.Len()) > cfg.MaxBodySize {
+		// The scan above ran against a truncated stream, so its verdict
+		// isn't meaningful; discard it the same way readBounded skips
+		// scanning altogether once ScanBuffered sees an oversize read.
+		return buf, true, nil, nil
+	}
+
+	if scanErr != nil {
+		return buf, false, nil, scanErr
+	}
+
+	return buf, false, findingFromResult(result, part, buf.Bytes()), nil
+}
+
+// scanBuffer scans content through cfg.Scanner and turns a FOUND verdict
+// into a Finding. part is the multipart field name, empty for a plain body.
+func (cfg Config) scanBuffer(r *http.Request, part string, content []byte) (*Finding, error) {
+	result, err := cfg.runScan(r, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	return findingFromResult(result, part, content), nil
+}
+
+// runScan scans stream through cfg.Scanner and reports the outcome via
+// cfg.OnEvent, if set.
+func (cfg Config) runScan(r *http.Request, stream io.Reader) (*clamd.ScanResult, error) {
+	ch, err := cfg.Scanner.ScanStream(r.Context(), stream)
+	if err != nil {
+		if cfg.OnEvent != nil {
+			cfg.OnEvent(r, nil, err)
+		}
+		return nil, err
+	}
+
+	result := <-ch
+
+	if cfg.OnEvent != nil {
+		cfg.OnEvent(r, result, nil)
+	}
+
+	return result, nil
+}
+
+// findingFromResult turns a FOUND verdict into a Finding carrying a sha256
+// hash of content; any other verdict yields a nil Finding.
+func findingFromResult(result *clamd.ScanResult, part string, content []byte) *Finding {
+	if result == nil || result.Status != clamd.RES_FOUND {
+		return nil
+	}
+
+	sum := sha256.Sum256(content)
+
+	return &Finding{
+		Signature: result.Description,
+		Part:      part,
+		Hash:      hex.EncodeToString(sum[:]),
+	}
+}
+
+func writeRejection(w http.ResponseWriter, status int, finding *Finding) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	//goland:noinspection GoUnhandledErrorResult
+	json.NewEncoder(w).Encode(finding)
+}
@@ -0,0 +1,195 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamdhttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	clamd "github.com/torbencarstensbit/go-clamd"
+)
+
+// fakeScanner is a Scanner test double. If err is set, ScanStream returns it
+// without touching r, mirroring Clamd.ScanStream's behavior on a dial
+// failure. Otherwise it drains r and replies with result.
+type fakeScanner struct {
+	result *clamd.ScanResult
+	err    error
+}
+
+func (f *fakeScanner) ScanStream(ctx context.Context, r io.Reader) (chan *clamd.ScanResult, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	io.Copy(io.Discard, r)
+
+	ch := make(chan *clamd.ScanResult, 1)
+	ch <- f.result
+	close(ch)
+	return ch, nil
+}
+
+// serve runs r through Middleware; next echoes back whatever body it
+// received so tests can tell a forwarded body from a rejection's JSON.
+func serve(cfg Config, r *http.Request) *httptest.ResponseRecorder {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		//goland:noinspection GoUnhandledErrorResult
+		w.Write(b)
+	})
+
+	w := httptest.NewRecorder()
+	Middleware(cfg, next).ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddlewareForwardsCleanBody(t *testing.T) {
+	cfg := Config{Scanner: &fakeScanner{result: &clamd.ScanResult{Status: clamd.RES_OK}}}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+
+	w := serve(cfg, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestMiddlewareRejectsFound(t *testing.T) {
+	cfg := Config{Scanner: &fakeScanner{result: &clamd.ScanResult{
+		Status:      clamd.RES_FOUND,
+		Description: "Eicar-Test-Signature",
+	}}}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("X5O!P%@AP"))
+
+	w := serve(cfg, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), "Eicar-Test-Signature") {
+		t.Errorf("body = %q, want it to mention the signature", w.Body.String())
+	}
+}
+
+func TestMiddlewareOversizeReject(t *testing.T) {
+	cfg := Config{
+		Scanner:     &fakeScanner{result: &clamd.ScanResult{Status: clamd.RES_OK}},
+		MaxBodySize: 4,
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too long"))
+
+	w := serve(cfg, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMiddlewareOversizeForward(t *testing.T) {
+	cfg := Config{
+		Scanner:     &fakeScanner{result: &clamd.ScanResult{Status: clamd.RES_OK}},
+		MaxBodySize: 4,
+		OnOversize:  OversizeForward,
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too long"))
+
+	w := serve(cfg, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Body.String() != "too long" {
+		t.Errorf("body = %q, want the full unscanned body", w.Body.String())
+	}
+}
+
+func TestMiddlewareMultipartScansFilePartOnly(t *testing.T) {
+	var body strings.Builder
+	writer := multipart.NewWriter(&body)
+
+	//goland:noinspection GoUnhandledErrorResult
+	field, _ := writer.CreateFormField("note")
+	field.Write([]byte("just a field"))
+
+	//goland:noinspection GoUnhandledErrorResult
+	file, _ := writer.CreateFormFile("upload", "eicar.txt")
+	file.Write([]byte("X5O!P%@AP"))
+
+	//goland:noinspection GoUnhandledErrorResult
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body.String()))
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	cfg := Config{Scanner: &fakeScanner{result: &clamd.ScanResult{
+		Status:      clamd.RES_FOUND,
+		Description: "Eicar-Test-Signature",
+	}}}
+
+	w := serve(cfg, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), `"part":"upload"`) {
+		t.Errorf("body = %q, want it to name the infected part", w.Body.String())
+	}
+}
+
+// TestMiddlewareScanParallelScannerErrorDoesNotHang reproduces the case
+// where ScanParallel's Scanner returns an error without ever reading the
+// pipe it was handed (e.g. Clamd.ScanStream failing to dial): the
+// goroutine copying the body into that pipe must still be released, or
+// Middleware's handler never returns.
+func TestMiddlewareScanParallelScannerErrorDoesNotHang(t *testing.T) {
+	cfg := Config{
+		Scanner: &fakeScanner{err: errors.New("dial clamd: connection refused")},
+		Mode:    ScanParallel,
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+
+	done := make(chan struct{})
+	go func() {
+		serve(cfg, r)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Middleware did not return after Scanner.ScanStream failed without reading the body")
+	}
+}
@@ -0,0 +1,317 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SessionPool maintains a bounded set of persistent clamd connections, each
+// switched into IDSESSION mode, so that many concurrent ScanStream/ScanFile
+// calls can be pipelined over a handful of sockets instead of paying a
+// fresh TCP/unix connect per scan. This is intended for high-volume
+// callers, such as an SMTP or HTTP gateway, that would otherwise dial
+// clamd once per request.
+type SessionPool struct {
+	address string
+	conns   []*sessionConn
+	next    uint64
+}
+
+// sessionConn is a single persistent IDSESSION connection. Every command is
+// assigned the id clamd will tag its response with, in the same writeMu
+// critical section that writes the command, so the id a request is
+// registered under always matches the id clamd actually echoes back;
+// responses are demultiplexed by a single read loop that looks up that id
+// rather than assuming replies arrive in enqueue order.
+type sessionConn struct {
+	conn *CLAMDConn
+
+	writeMu sync.Mutex
+	nextID  uint64
+
+	pendingMu sync.Mutex
+	pending   map[uint64]*pendingRequest
+	dead      bool
+}
+
+type pendingRequest struct {
+	ch      chan *ScanResult
+	discard int32
+}
+
+// NewSessionPool dials size persistent connections to address and switches
+// each of them into IDSESSION mode. ctx governs the dial deadline shared by
+// every connection in the pool; it does not bound requests issued against
+// the pool afterwards. tlsConfig is used to dial "tls://"/"clamd+tls://"
+// addresses, as with Clamd.SetTLSConfig; it is ignored for other schemes
+// and may be nil.
+func NewSessionPool(ctx context.Context, address string, size int, tlsConfig *tls.Config) (*SessionPool, error) {
+	if size <= 0 {
+		return nil, errors.New("clamd: session pool size must be positive")
+	}
+
+	pool := &SessionPool{address: address}
+
+	for i := 0; i < size; i++ {
+		sc, err := newSessionConn(ctx, address, tlsConfig)
+		if err != nil {
+			//goland:noinspection GoUnhandledErrorResult
+			pool.Close()
+			return nil, err
+		}
+
+		pool.conns = append(pool.conns, sc)
+	}
+
+	return pool, nil
+}
+
+func newSessionConn(ctx context.Context, address string, tlsConfig *tls.Config) (*sessionConn, error) {
+	c := &Clamd{address: address, tlsConfig: tlsConfig}
+
+	conn, err := c.newConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.sendCommand(ctx, "IDSESSION"); err != nil {
+		//goland:noinspection GoUnhandledErrorResult
+		conn.Close()
+		return nil, err
+	}
+
+	sc := &sessionConn{conn: conn, pending: make(map[uint64]*pendingRequest)}
+	go sc.readLoop()
+
+	return sc, nil
+}
+
+func (sc *sessionConn) readLoop() {
+	reader := bufio.NewReader(sc.conn.conn)
+
+	for {
+		line, err := reader.ReadString(0)
+		if err != nil {
+			sc.drain()
+			return
+		}
+
+		line = strings.TrimRight(line, "\x00")
+		line = strings.TrimRight(line, "\n")
+
+		sc.deliver(line)
+	}
+}
+
+// deliver looks up the pending request for line's leading "<id>: " tag and,
+// unless it has been marked for discard, hands it the parsed response. A
+// command whose scan covers multiple files (e.g. ScanFile on a directory)
+// makes clamd send several lines under the same id; only the first is
+// delivered; once an id's entry is removed from pending, any further line
+// carrying that id is a continuation of an already-answered request and is
+// dropped rather than mismatched against a different caller.
+func (sc *sessionConn) deliver(line string) {
+	id, rest, ok := parseSessionLine(line)
+	if !ok {
+		return
+	}
+
+	sc.pendingMu.Lock()
+	req, found := sc.pending[id]
+	if found {
+		delete(sc.pending, id)
+	}
+	sc.pendingMu.Unlock()
+
+	if !found || atomic.LoadInt32(&req.discard) != 0 {
+		return
+	}
+
+	req.ch <- parseResponse(rest)
+	close(req.ch)
+}
+
+// drain fails every still-pending request once the connection's read loop
+// exits, e.g. because clamd closed the socket, and marks sc dead so
+// scanCommand stops registering new requests against it instead of
+// panicking on a nil map.
+func (sc *sessionConn) drain() {
+	sc.pendingMu.Lock()
+	pending := sc.pending
+	sc.pending = nil
+	sc.dead = true
+	sc.pendingMu.Unlock()
+
+	for _, req := range pending {
+		if atomic.LoadInt32(&req.discard) == 0 {
+			close(req.ch)
+		}
+	}
+}
+
+// parseSessionLine splits the leading "<id>: " tag clamd adds to every
+// response while a connection is in IDSESSION mode from the rest of the
+// line, reporting false if line isn't tagged with an id at all.
+func parseSessionLine(line string) (id uint64, rest string, ok bool) {
+	idx := strings.Index(line, ": ")
+	if idx < 0 {
+		return 0, "", false
+	}
+
+	n, err := strconv.ParseUint(line[:idx], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return n, line[idx+2:], true
+}
+
+func (p *SessionPool) pick() *sessionConn {
+	idx := atomic.AddUint64(&p.next, 1) % uint64(len(p.conns))
+	return p.conns[idx]
+}
+
+// scanCommand issues command on one of the pool's connections, optionally
+// streaming body as INSTREAM chunks afterwards, and waits for its
+// correlated response. If ctx is cancelled before a response arrives, the
+// pending request is marked for discard so the demuxer drops its answer
+// instead of misdelivering it to a future caller. If the connection picked
+// has already died (its read loop exited and called drain), scanCommand
+// fails the request instead of registering it, rather than writing into
+// the nil pending map drain left behind.
+func (p *SessionPool) scanCommand(ctx context.Context, command string, body io.Reader) (*ScanResult, error) {
+	sc := p.pick()
+
+	req := &pendingRequest{ch: make(chan *ScanResult, 1)}
+
+	// The id a request is registered under must match the id clamd will
+	// tag its response with, which is assigned in the order commands are
+	// written to the wire. Registering pending[id] here, before releasing
+	// writeMu, keeps that assignment atomic with the write: a concurrent
+	// scanCommand on the same connection can't write its command and have
+	// it land between this one's id assignment and its write.
+	sc.writeMu.Lock()
+	id := sc.nextID + 1
+	sc.nextID = id
+
+	sc.pendingMu.Lock()
+	if sc.dead {
+		sc.pendingMu.Unlock()
+		sc.writeMu.Unlock()
+		return nil, errors.New("clamd: session connection is closed")
+	}
+	sc.pending[id] = req
+	sc.pendingMu.Unlock()
+
+	err := sc.conn.sendSessionCommand(ctx, command)
+	if err == nil && body != nil {
+		err = sendStreamChunks(ctx, sc.conn, body)
+	}
+	sc.writeMu.Unlock()
+
+	if err != nil {
+		//goland:noinspection GoUnhandledErrorResult
+		sc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case res, ok := <-req.ch:
+		if !ok {
+			return nil, errors.New("clamd: session connection closed before a response arrived")
+		}
+		return res, nil
+	case <-ctx.Done():
+		atomic.StoreInt32(&req.discard, 1)
+
+		// Remove id from the demux table so a cancelled request's entry
+		// doesn't linger in sc.pending until a now-useless response
+		// eventually arrives, or forever if one never does.
+		sc.pendingMu.Lock()
+		delete(sc.pending, id)
+		sc.pendingMu.Unlock()
+
+		return nil, ctx.Err()
+	}
+}
+
+func sendStreamChunks(ctx context.Context, conn *CLAMDConn, r io.Reader) error {
+	for {
+		buf := make([]byte, CHUNK_SIZE)
+
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			if werr := conn.sendSessionChunk(ctx, buf[0:nr]); werr != nil {
+				return werr
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+	}
+
+	return conn.sendSessionEOF(ctx)
+}
+
+// ScanStream pipelines a stream scan over one of the pool's persistent
+// IDSESSION connections instead of opening a new connection per call.
+func (p *SessionPool) ScanStream(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	return p.scanCommand(ctx, "INSTREAM", r)
+}
+
+// ScanFile scans a file or directory already visible to clamd (a full path
+// is required) over the session pool instead of a one-shot connection.
+func (p *SessionPool) ScanFile(ctx context.Context, path string) (*ScanResult, error) {
+	return p.scanCommand(ctx, fmt.Sprintf("SCAN %s", path), nil)
+}
+
+// Close ends every connection in the pool, failing any request still
+// waiting on one of them.
+func (p *SessionPool) Close() error {
+	var firstErr error
+
+	for _, sc := range p.conns {
+		if err := sc.conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,286 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startFakeSessionServer listens on 127.0.0.1:0, accepts a single
+// connection, completes the IDSESSION handshake, and answers each INSTREAM
+// it receives by calling respond with the streamed content. Replies are
+// sent from their own goroutine so a slow respond call doesn't hold up
+// reading (and assigning ids to) the commands that follow it, letting
+// tests exercise out-of-order delivery.
+func startFakeSessionServer(t *testing.T, respond func(content []byte) string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() {
+		//goland:noinspection GoUnhandledErrorResult
+		ln.Close()
+	})
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := newSessionReader(conn)
+
+		if cmd, err := r.readCommand(); err != nil || cmd != "IDSESSION" {
+			return
+		}
+
+		var writeMu sync.Mutex
+		var id uint64
+
+		for {
+			cmd, err := r.readCommand()
+			if err != nil {
+				return
+			}
+			if cmd != "INSTREAM" {
+				continue
+			}
+
+			content, err := r.readInstream()
+			if err != nil {
+				return
+			}
+
+			id++
+			go func(id uint64, content []byte) {
+				status := respond(content)
+
+				writeMu.Lock()
+				defer writeMu.Unlock()
+				fmt.Fprintf(conn, "%d: %s\n\000", id, status)
+			}(id, content)
+		}
+	}()
+
+	return "tcp://" + ln.Addr().String()
+}
+
+type sessionReader struct {
+	buf []byte
+	net.Conn
+}
+
+func newSessionReader(conn net.Conn) *sessionReader {
+	return &sessionReader{Conn: conn}
+}
+
+// readCommand reads one NUL-terminated "z<command>" line, stripping the "z".
+func (r *sessionReader) readCommand() (string, error) {
+	line, err := r.readUntil(0)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimPrefix(strings.TrimSuffix(line, "\x00"), "z"), nil
+}
+
+// readInstream reads length-prefixed INSTREAM chunks until the zero-length
+// terminator, returning the concatenated content.
+func (r *sessionReader) readInstream() ([]byte, error) {
+	var content []byte
+
+	for {
+		lenBuf, err := r.readN(4)
+		if err != nil {
+			return nil, err
+		}
+
+		n := binary.BigEndian.Uint32(lenBuf)
+		if n == 0 {
+			return content, nil
+		}
+
+		chunk, err := r.readN(int(n))
+		if err != nil {
+			return nil, err
+		}
+
+		content = append(content, chunk...)
+	}
+}
+
+func (r *sessionReader) readN(n int) ([]byte, error) {
+	for len(r.buf) < n {
+		chunk := make([]byte, 4096)
+		nr, err := r.Read(chunk)
+		if nr > 0 {
+			r.buf = append(r.buf, chunk[:nr]...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := r.buf[:n]
+	r.buf = r.buf[n:]
+	return out, nil
+}
+
+func (r *sessionReader) readUntil(delim byte) (string, error) {
+	for {
+		if idx := indexByte(r.buf, delim); idx >= 0 {
+			out := string(r.buf[:idx+1])
+			r.buf = r.buf[idx+1:]
+			return out, nil
+		}
+
+		chunk := make([]byte, 4096)
+		nr, err := r.Read(chunk)
+		if nr > 0 {
+			r.buf = append(r.buf, chunk[:nr]...)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func indexByte(b []byte, c byte) int {
+	for i, v := range b {
+		if v == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// TestSessionPoolCorrelatesConcurrentScansByID sends two INSTREAM scans
+// over the same pooled connection where the server replies to the second
+// before the first, and checks each caller still gets its own result
+// rather than the other's.
+func TestSessionPoolCorrelatesConcurrentScansByID(t *testing.T) {
+	addr := startFakeSessionServer(t, func(content []byte) string {
+		if string(content) == "slow" {
+			time.Sleep(50 * time.Millisecond)
+			return "stream: OK"
+		}
+		return "stream: Eicar-Test-Signature FOUND"
+	})
+
+	pool, err := NewSessionPool(context.Background(), addr, 1, nil)
+	if err != nil {
+		t.Fatalf("NewSessionPool: %s", err)
+	}
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := map[string]*ScanResult{}
+
+	for _, body := range []string{"slow", "fast"} {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
+
+			res, err := pool.ScanStream(context.Background(), strings.NewReader(body))
+			if err != nil {
+				t.Errorf("ScanStream(%q): %s", body, err)
+				return
+			}
+
+			mu.Lock()
+			results[body] = res
+			mu.Unlock()
+		}(body)
+	}
+
+	wg.Wait()
+
+	if got := results["slow"]; got == nil || got.Status != RES_OK {
+		t.Errorf("slow result = %+v, want Status %s", got, RES_OK)
+	}
+	if got := results["fast"]; got == nil || got.Status != RES_FOUND {
+		t.Errorf("fast result = %+v, want Status %s", got, RES_FOUND)
+	}
+}
+
+// TestSessionPoolCancelledScanDoesNotBreakOthers is a regression test for
+// the shared-connection bug: cancelling one caller's ctx while its scan is
+// still outstanding must not tear down the sessionConn out from under a
+// later scan on the same pool.
+func TestSessionPoolCancelledScanDoesNotBreakOthers(t *testing.T) {
+	hold := make(chan struct{})
+
+	addr := startFakeSessionServer(t, func(content []byte) string {
+		if string(content) == "block" {
+			<-hold
+		}
+		return "stream: OK"
+	})
+
+	pool, err := NewSessionPool(context.Background(), addr, 1, nil)
+	if err != nil {
+		t.Fatalf("NewSessionPool: %s", err)
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = pool.ScanStream(ctx, strings.NewReader("block"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled ScanStream error = %v, want context.DeadlineExceeded", err)
+	}
+
+	sc := pool.conns[0]
+	sc.pendingMu.Lock()
+	pending := len(sc.pending)
+	sc.pendingMu.Unlock()
+	if pending != 0 {
+		t.Errorf("sc.pending has %d entries after cancellation, want 0", pending)
+	}
+
+	close(hold)
+
+	res, err := pool.ScanStream(context.Background(), strings.NewReader("ok"))
+	if err != nil {
+		t.Fatalf("ScanStream after a cancelled sibling failed: %s", err)
+	}
+	if res.Status != RES_OK {
+		t.Errorf("Status = %s, want %s", res.Status, RES_OK)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build windows
+
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ScanFD is unavailable on windows: FILDES relies on passing a file
+// descriptor over a unix socket via an SCM_RIGHTS ancillary message, which
+// windows does not support.
+func (c *Clamd) ScanFD(ctx context.Context, fd uintptr) (*ScanResult, error) {
+	return nil, errors.New("clamd: ScanFD is not supported on windows")
+}
+
+// scanFileByFD has no FILDES fast path on windows; it sends the SCAN
+// command instead, the same as ScanFile does for a non-unix-socket address.
+func (c *Clamd) scanFileByFD(ctx context.Context, path string) (*ScanResult, error) {
+	ch, err := c.simpleCommand(ctx, fmt.Sprintf("SCAN %s", path))
+	if err != nil {
+		return nil, err
+	}
+
+	return <-ch, nil
+}
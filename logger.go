@@ -0,0 +1,96 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import "time"
+
+// Logger is the diagnostic sink Clamd writes to instead of printing
+// straight to stdout/stderr, which is unusable once the library is
+// embedded in a server. Implementations must be safe for concurrent use,
+// since commands may run concurrently. The default Logger is a no-op.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debugf(format string, args ...interface{}) {}
+func (noopLogger) Infof(format string, args ...interface{})  {}
+func (noopLogger) Warnf(format string, args ...interface{})  {}
+func (noopLogger) Errorf(format string, args ...interface{}) {}
+
+// ScanEvent describes the duration of one phase of a command's round trip
+// to clamd, e.g. the time spent connecting versus waiting for a response.
+type ScanEvent struct {
+	Command  string
+	Phase    string
+	Duration time.Duration
+}
+
+// OnScanEvent is called, if set on a Clamd, once per phase of every
+// command it sends on its own one-shot connection (Ping, Version, Stats,
+// Reload, Shutdown, the SCAN-based *ScanFile calls and ScanStream). ScanFD,
+// ScanFile's FILDES path and scans served by a SessionPool report no
+// events. This lets callers export scan timings as Prometheus
+// histograms or OpenTelemetry spans without patching the library. It must
+// return quickly: Clamd invokes it inline, not in its own goroutine.
+type OnScanEvent func(ScanEvent)
+
+// SetLogger replaces c's Logger. Passing nil restores the default no-op
+// Logger.
+func (c *Clamd) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = noopLogger{}
+	}
+
+	c.logger = logger
+}
+
+// SetOnScanEvent replaces c's OnScanEvent callback. Passing nil disables
+// event reporting.
+func (c *Clamd) SetOnScanEvent(fn OnScanEvent) {
+	c.onScanEvent = fn
+}
+
+// log returns c's Logger, falling back to a no-op one when none has been
+// set via SetLogger (NewClamd and NewPooledClamd leave it unset, as does a
+// Clamd built as a struct literal).
+func (c *Clamd) log() Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+
+	return noopLogger{}
+}
+
+func (c *Clamd) emit(command, phase string, d time.Duration) {
+	if c.onScanEvent != nil {
+		c.onScanEvent(ScanEvent{Command: command, Phase: phase, Duration: d})
+	}
+}
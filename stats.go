@@ -0,0 +1,237 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stats is clamd's STATS reply, parsed into typed fields. clamd doesn't
+// document this format, only commits to it being human-readable, so fields
+// this package doesn't recognize within a known section are silently
+// dropped (a line outside any known section makes parsing fail); Raw keeps
+// the full reply around for callers who want to parse it themselves.
+type Stats struct {
+	Raw string
+
+	Pools int
+
+	PrimaryThreadsLive int
+	PrimaryThreadsIdle int
+	PrimaryThreadsMax  int
+
+	QueueDepth int
+	StateItems []QueueItem
+
+	// MemHeap, MemMMap, MemUsed, MemFree and MemReleasable are in bytes.
+	// A value clamd reports as "N/A" on the current platform is stored as -1.
+	MemHeap       int64
+	MemMMap       int64
+	MemUsed       int64
+	MemFree       int64
+	MemReleasable int64
+}
+
+// QueueItem is one in-flight scan reported by clamd's STATS queue dump.
+type QueueItem struct {
+	ID      string
+	Age     time.Duration
+	Command string
+	File    string
+}
+
+// parseStats turns the STATS reply into a Stats. The response records are
+// split on newlines first, so a reply delivered as one multi-line record
+// parses the same as one delivered line by line. Lines are grouped by the
+// section header (POOLS/STATE/THREADS/QUEUE/MEMSTATS) they follow; only the
+// QUEUE section is expected to span multiple lines.
+func parseStats(lines []string) (*Stats, error) {
+	stats := &Stats{Raw: strings.Join(lines, "\n")}
+
+	section := ""
+
+	for _, line := range strings.Split(stats.Raw, "\n") {
+		switch {
+		case strings.HasPrefix(line, "POOLS:"):
+			section = "POOLS"
+			if err := parsePools(line, stats); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "STATE:"):
+			section = "STATE"
+		case strings.HasPrefix(line, "THREADS:"):
+			section = "THREADS"
+			parseThreads(line, stats)
+		case strings.HasPrefix(line, "QUEUE:"):
+			section = "QUEUE"
+			parseQueueDepth(line, stats)
+		case strings.HasPrefix(line, "MEMSTATS:"):
+			section = "MEMSTATS"
+			parseMemstats(line, stats)
+		case line == "" || line == "END":
+			section = ""
+		default:
+			if section == "QUEUE" {
+				if item, ok := parseQueueItem(line); ok {
+					stats.StateItems = append(stats.StateItems, item)
+				}
+				continue
+			}
+
+			if section == "" {
+				return nil, errors.New(fmt.Sprintf("clamd: unrecognized STATS line %q", line))
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+func parsePools(line string, stats *Stats) error {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return errors.New(fmt.Sprintf("clamd: malformed POOLS line %q", line))
+	}
+
+	n, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return errors.New(fmt.Sprintf("clamd: malformed POOLS line %q: %s", line, err))
+	}
+
+	stats.Pools = n
+	return nil
+}
+
+// parseThreads parses a line like
+// "THREADS: live 1  idle: 0 max: 12 idle-timeout: 30".
+func parseThreads(line string, stats *Stats) {
+	fields := strings.Fields(line)
+
+	for i, f := range fields {
+		if i+1 >= len(fields) {
+			break
+		}
+
+		switch strings.TrimSuffix(f, ":") {
+		case "live":
+			stats.PrimaryThreadsLive, _ = strconv.Atoi(fields[i+1])
+		case "idle":
+			stats.PrimaryThreadsIdle, _ = strconv.Atoi(fields[i+1])
+		case "max":
+			stats.PrimaryThreadsMax, _ = strconv.Atoi(fields[i+1])
+		}
+	}
+}
+
+// parseQueueDepth parses a line like "QUEUE: 0 items".
+func parseQueueDepth(line string, stats *Stats) {
+	fields := strings.Fields(line)
+	if len(fields) >= 2 {
+		stats.QueueDepth, _ = strconv.Atoi(fields[1])
+	}
+}
+
+// parseMemstats parses a line of "key value" pairs such as
+// "MEMSTATS: heap N/A mmap 3.871M used 3.889M free 0.018M releasable 0.000M".
+func parseMemstats(line string, stats *Stats) {
+	fields := strings.Fields(strings.TrimPrefix(line, "MEMSTATS:"))
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		size, ok := parseMemSize(fields[i+1])
+		if !ok {
+			continue
+		}
+
+		switch fields[i] {
+		case "heap":
+			stats.MemHeap = size
+		case "mmap":
+			stats.MemMMap = size
+		case "used":
+			stats.MemUsed = size
+		case "free":
+			stats.MemFree = size
+		case "releasable":
+			stats.MemReleasable = size
+		}
+	}
+}
+
+// parseMemSize parses a MEMSTATS value such as "3.871M", "512K", or the
+// literal "N/A", returning bytes. "N/A" parses to -1.
+func parseMemSize(value string) (int64, bool) {
+	if value == "N/A" {
+		return -1, true
+	}
+
+	unit := int64(1)
+
+	switch {
+	case strings.HasSuffix(value, "G"):
+		unit = 1024 * 1024 * 1024
+		value = strings.TrimSuffix(value, "G")
+	case strings.HasSuffix(value, "M"):
+		unit = 1024 * 1024
+		value = strings.TrimSuffix(value, "M")
+	case strings.HasSuffix(value, "K"):
+		unit = 1024
+		value = strings.TrimSuffix(value, "K")
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(f * float64(unit)), true
+}
+
+// parseQueueItem parses one line of the STATS queue dump, of the form
+// "<id>: <age-in-seconds> <command> <file>". Lines it cannot make sense of
+// are skipped rather than treated as an error, since clamd does not
+// document this format and it has changed between releases.
+func parseQueueItem(line string) (QueueItem, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return QueueItem{}, false
+	}
+
+	age, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return QueueItem{}, false
+	}
+
+	return QueueItem{
+		ID:      strings.TrimSuffix(fields[0], ":"),
+		Age:     time.Duration(age * float64(time.Second)),
+		Command: fields[2],
+		File:    strings.Join(fields[3:], " "),
+	}, true
+}
@@ -0,0 +1,113 @@
+/*
+Open Source Initiative OSI - The MIT License (MIT):Licensing
+
+The MIT License (MIT)
+Copyright (c) 2013 DutchCoders <http://github.com/dutchcoders/>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+of the Software, and to permit persons to whom the Software is furnished to do
+so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package clamd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseMemSize(t *testing.T) {
+	mib := float64(1024 * 1024)
+
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"N/A", -1, true},
+		{"0.000M", 0, true},
+		{"512K", 512 * 1024, true},
+		{"3.871M", int64(3.871 * mib), true},
+		{"1G", 1024 * 1024 * 1024, true},
+		{"not-a-number", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseMemSize(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("parseMemSize(%q) ok = %v, want %v", tt.value, ok, tt.ok)
+			}
+			if ok && got != tt.want {
+				t.Errorf("parseMemSize(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseThreads(t *testing.T) {
+	stats := &Stats{}
+	parseThreads("THREADS: live 1  idle: 0 max: 12 idle-timeout: 30", stats)
+
+	if stats.PrimaryThreadsLive != 1 {
+		t.Errorf("PrimaryThreadsLive = %d, want 1", stats.PrimaryThreadsLive)
+	}
+	if stats.PrimaryThreadsIdle != 0 {
+		t.Errorf("PrimaryThreadsIdle = %d, want 0", stats.PrimaryThreadsIdle)
+	}
+	if stats.PrimaryThreadsMax != 12 {
+		t.Errorf("PrimaryThreadsMax = %d, want 12", stats.PrimaryThreadsMax)
+	}
+}
+
+func TestParseQueueItem(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want QueueItem
+		ok   bool
+	}{
+		{
+			name: "well-formed",
+			line: "7: 2.5 SCAN /tmp/upload/file.zip",
+			want: QueueItem{ID: "7", Age: 2500 * time.Millisecond, Command: "SCAN", File: "/tmp/upload/file.zip"},
+			ok:   true,
+		},
+		{
+			name: "too short",
+			line: "7: 2.5",
+			ok:   false,
+		},
+		{
+			name: "malformed age",
+			line: "7: soon SCAN /tmp/file",
+			ok:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseQueueItem(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("parseQueueItem(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			}
+			if ok && got != tt.want {
+				t.Errorf("parseQueueItem(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}